@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mode controls how this daemon treats the packets it receives: a
+// "standalone" daemon behaves exactly like the original statsdaemon, a
+// "leaf" daemon forwards pre-aggregated metrics upstream instead of (or in
+// addition to) Graphite, and an "aggregator" daemon accepts those forwarded
+// metrics over TCP and reduces them before its own flush to Graphite.
+const (
+	ModeStandalone = "standalone"
+	ModeLeaf       = "leaf"
+	ModeAggregator = "aggregator"
+)
+
+var (
+	mode         = flag.String("mode", ModeStandalone, "one of standalone|leaf|aggregator")
+	tcpAddress   = flag.String("tcp-address", ":8126", "TCP service address for aggregator mode")
+	upstream     = flag.String("upstream", "", "host:port of an aggregator instance (leaf mode)")
+)
+
+// aggregation identifiers used on the wire between leaf and aggregator
+// instances. Counters are reduced with AggSum or AggLast, gauges with
+// AggLast, AggMin, AggMax or AggMean, and timers with AggRaw so the
+// aggregator can still compute accurate percentiles across hosts.
+const (
+	AggSum   = "sum"
+	AggMean  = "mean"
+	AggMin   = "min"
+	AggMax   = "max"
+	AggLast  = "last"
+	AggRaw   = "raw-timings"
+)
+
+// frameTerminator marks the end of a batch of forwarded lines so a partial
+// read on either side can always resume at a line boundary.
+const frameTerminator = "\n\n"
+
+// encodePacket renders a Packet as a single
+// "bucket|value|modifier|aggregation|setmember" line for the
+// leaf->aggregator wire protocol. setmember is only meaningful for "s"
+// (set) packets and is empty otherwise.
+func encodePacket(p *Packet) string {
+	agg := p.Aggregation
+	if agg == "" {
+		agg = defaultAggregation(p.Modifier)
+	}
+	return fmt.Sprintf("%s|%d|%s|%s|%s", p.Bucket, p.Value, p.Modifier, agg, p.SetMember)
+}
+
+// decodePacketLine parses one line of the wire protocol back into a Packet.
+func decodePacketLine(line string) (*Packet, error) {
+	fields := strings.Split(line, "|")
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("malformed aggregator frame: %q", line)
+	}
+	value, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	return &Packet{
+		Bucket:      fields[0],
+		Value:       value,
+		Modifier:    fields[2],
+		Sampling:    1,
+		Aggregation: fields[3],
+		SetMember:   fields[4],
+	}, nil
+}
+
+func defaultAggregation(modifier string) string {
+	switch modifier {
+	case "c":
+		return AggSum
+	case "g":
+		return AggLast
+	case "ms", "h":
+		return AggRaw
+	default: // "s": sets are unioned by bucket regardless of Aggregation
+		return AggLast
+	}
+}
+
+// digestFramePrefix marks a forwarded line as a whole TDigest rather than a
+// single Packet, so a leaf can forward a bucket's compacted centroids
+// directly instead of re-expanding them into raw samples.
+const digestFramePrefix = "D|"
+
+// digestFrame carries one bucket's decoded centroids from handleAggregatorConn
+// to monitor(), the same way a Packet carries s.Bucket/s.Value/etc: the
+// actual merge into timers still only ever happens on monitor()'s goroutine.
+type digestFrame struct {
+	Bucket string
+	Digest *TDigest
+}
+
+// digestIn is the digestFrame analogue of In, read by monitor()'s select
+// loop.
+var digestIn = make(chan digestFrame, 100)
+
+// encodeDigestFrame renders bucket's digest as "D|bucket|mean:weight,...".
+func encodeDigestFrame(bucket string, td *TDigest) string {
+	centroids := td.Centroids()
+	parts := make([]string, len(centroids))
+	for i, c := range centroids {
+		parts[i] = fmt.Sprintf("%g:%g", c.Mean, c.Weight)
+	}
+	return digestFramePrefix + bucket + "|" + strings.Join(parts, ",")
+}
+
+// decodeDigestFrame parses a line produced by encodeDigestFrame back into a
+// bucket name and a fresh TDigest built from its centroids.
+func decodeDigestFrame(line string) (string, *TDigest, error) {
+	rest := strings.TrimPrefix(line, digestFramePrefix)
+	bucket, centroidList, ok := strings.Cut(rest, "|")
+	if !ok {
+		return "", nil, fmt.Errorf("malformed digest frame: %q", line)
+	}
+	td := NewTDigest()
+	if centroidList == "" {
+		return bucket, td, nil
+	}
+	for _, part := range strings.Split(centroidList, ",") {
+		meanStr, weightStr, ok := strings.Cut(part, ":")
+		if !ok {
+			return "", nil, fmt.Errorf("malformed digest centroid %q in frame %q", part, line)
+		}
+		mean, err := strconv.ParseFloat(meanStr, 64)
+		if err != nil {
+			return "", nil, err
+		}
+		weight, err := strconv.ParseFloat(weightStr, 64)
+		if err != nil {
+			return "", nil, err
+		}
+		td.InsertWeighted(mean, weight)
+	}
+	return bucket, td, nil
+}
+
+// tcpListener is the aggregator-mode sibling of udpListener: it accepts
+// connections from leaf instances, decodes framed batches, and pushes the
+// resulting Packets onto the existing In channel (and digest frames onto
+// digestIn) so reduction happens inside the single-goroutine monitor()
+// select loop.
+func tcpListener() {
+	listener, err := net.Listen("tcp", *tcpAddress)
+	if err != nil {
+		log.Fatalf("ListenTCP: %s", err.Error())
+	}
+	defer listener.Close()
+	log.Printf("Listening on %s (aggregator mode)", *tcpAddress)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("error accepting connection %s", err.Error())
+			continue
+		}
+		go handleAggregatorConn(conn)
+	}
+}
+
+func handleAggregatorConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if line == "\n" {
+			// end of batch marker (each of frameTerminator's two newlines
+			// arrives as an empty line)
+			continue
+		}
+		line = strings.TrimRight(line, "\n")
+		if line != "" {
+			if strings.HasPrefix(line, digestFramePrefix) {
+				if bucket, td, err := decodeDigestFrame(line); err == nil {
+					digestIn <- digestFrame{Bucket: bucket, Digest: td}
+				} else {
+					log.Printf("%s", err.Error())
+				}
+			} else if p, err := decodePacketLine(line); err == nil {
+				In <- p
+			} else {
+				log.Printf("%s", err.Error())
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// leafForward maintains a persistent TCP connection to -upstream and
+// forwards every batch of wire-protocol lines (encodePacket/encodeDigestFrame
+// output) handed to it, reconnecting with backoff on failure. Like
+// backendWorker, it owns its own queue and background goroutine so a down or
+// slow upstream never blocks monitor()'s select loop: submit() only ever
+// enqueues.
+type leafForward struct {
+	conn    net.Conn
+	backoff time.Duration
+	queue   chan []string
+}
+
+func newLeafForward() *leafForward {
+	l := &leafForward{backoff: time.Second, queue: make(chan []string, 10)}
+	go l.run()
+	return l
+}
+
+func (l *leafForward) run() {
+	for lines := range l.queue {
+		l.send(lines)
+	}
+}
+
+// enqueue hands a batch of lines to the background goroutine, dropping it if
+// that goroutine is still busy reconnecting rather than blocking submit().
+func (l *leafForward) enqueue(lines []string) {
+	select {
+	case l.queue <- lines:
+	default:
+		log.Printf("leaf forward: queue full, dropping %d lines", len(lines))
+	}
+}
+
+func (l *leafForward) ensureConn() error {
+	if l.conn != nil {
+		return nil
+	}
+	conn, err := net.Dial("tcp", *upstream)
+	if err != nil {
+		return err
+	}
+	l.conn = conn
+	l.backoff = time.Second
+	return nil
+}
+
+// send writes a batch of lines to the aggregator, reconnecting with
+// exponential backoff (capped at 30s) if the upstream connection is down.
+// A batch that cannot be dialed or written is dropped, not resent.
+func (l *leafForward) send(lines []string) {
+	if err := l.ensureConn(); err != nil {
+		log.Printf("error dialing upstream %s: %s", *upstream, err.Error())
+		time.Sleep(l.backoff)
+		l.backoff *= 2
+		if l.backoff > 30*time.Second {
+			l.backoff = 30 * time.Second
+		}
+		return
+	}
+	var buf strings.Builder
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(frameTerminator)
+	if _, err := l.conn.Write([]byte(buf.String())); err != nil {
+		log.Printf("error writing to upstream %s: %s", *upstream, err.Error())
+		l.conn.Close()
+		l.conn = nil
+	}
+}
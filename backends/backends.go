@@ -0,0 +1,170 @@
+// Package backends implements statsdaemon's pluggable flush destinations.
+// Each -backend URL becomes one Backend running its own queue and backoff
+// (via worker), so a slow or down backend never blocks delivery to the
+// others.
+package backends
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Metric is the flushed, backend-agnostic form of a single stat line: the
+// same bucket/value/timestamp triples that used to be written straight into
+// the Graphite plaintext buffer in submit(). Tags is only populated under
+// -tag-mode=native; backends that don't understand tags natively (graphite,
+// pickle, redis) simply ignore it.
+type Metric struct {
+	Bucket    string
+	Value     float64
+	Timestamp int64
+	Tags      map[string]string
+}
+
+// Backend is implemented by every output statsdaemon can flush to. Write is
+// called once per flush interval with the full batch for that interval; a
+// failing backend must not affect any other configured backend.
+type Backend interface {
+	Name() string
+	Write(metrics []Metric) error
+}
+
+// URLs collects repeated -backend flags, e.g.
+// -backend=graphite://host:2003 -backend=redis://host:6379/metrics
+type URLs []string
+
+func (u *URLs) String() string {
+	return strings.Join(*u, ",")
+}
+
+func (u *URLs) Set(s string) error {
+	*u = append(*u, s)
+	return nil
+}
+
+// Flags collects every -backend flag given on the command line, or swapped
+// in wholesale from a config file's "backends" key; Setup falls back to a
+// single Graphite backend when it's empty.
+var Flags URLs
+
+func init() {
+	flag.Var(&Flags, "backend", "backend URL (may be given multiple times); graphite://, graphite-pickle://, influx-udp://, redis://host:port/key")
+}
+
+// New parses one -backend URL into a concrete Backend implementation.
+func New(rawURL string) (Backend, error) {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid -backend %q: missing scheme", rawURL)
+	}
+	switch scheme {
+	case "graphite":
+		return &graphiteBackend{address: rest}, nil
+	case "graphite-pickle":
+		return &picklebackend{address: rest}, nil
+	case "influx-udp":
+		return &influxUDPBackend{address: rest}, nil
+	case "redis":
+		address, key, _ := strings.Cut(rest, "/")
+		if key == "" {
+			key = "metrics"
+		}
+		return &redisBackend{address: address, key: key}, nil
+	default:
+		return nil, fmt.Errorf("invalid -backend %q: unknown scheme %q", rawURL, scheme)
+	}
+}
+
+// worker pairs a Backend with its own queue and backoff so one slow or down
+// backend never blocks delivery to the others. A batch whose Write fails is
+// dropped, not retried; the worker then sleeps for a doubling backoff before
+// taking the next batch.
+type worker struct {
+	backend Backend
+	queue   chan []Metric
+}
+
+func newWorker(b Backend) *worker {
+	w := &worker{backend: b, queue: make(chan []Metric, 10)}
+	go w.run()
+	return w
+}
+
+func (w *worker) run() {
+	backoff := time.Second
+	for batch := range w.queue {
+		if err := w.backend.Write(batch); err != nil {
+			log.Printf("backend %s: %s (batch dropped, backing off %s)", w.backend.Name(), err.Error(), backoff)
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+func (w *worker) enqueue(metrics []Metric) {
+	select {
+	case w.queue <- metrics:
+	default:
+		log.Printf("backend %s: queue full, dropping %d metrics", w.backend.Name(), len(metrics))
+	}
+}
+
+// stop closes the worker's queue so its run loop drains whatever is queued
+// and exits, instead of leaking a goroutine when the backend is replaced.
+func (w *worker) stop() {
+	close(w.queue)
+}
+
+// workers holds one worker per configured -backend, set up by Setup.
+var workers []*worker
+
+// Setup parses Flags into new backend workers and swaps them in, stopping
+// whatever workers were previously running. Every URL is parsed before
+// anything is swapped or stopped, so a single invalid URL (e.g. from a bad
+// SIGHUP reload) leaves the existing, working backends in place instead of
+// tearing them down. defaultURL is used when Flags is empty, preserving the
+// pre-existing "plain Graphite" default.
+func Setup(defaultURL string) error {
+	urls := []string(Flags)
+	if len(urls) == 0 {
+		urls = []string{defaultURL}
+	}
+
+	built := make([]Backend, 0, len(urls))
+	for _, u := range urls {
+		b, err := New(u)
+		if err != nil {
+			return err
+		}
+		built = append(built, b)
+	}
+
+	old := workers
+	workers = nil
+	for _, b := range built {
+		workers = append(workers, newWorker(b))
+	}
+	for _, w := range old {
+		w.stop()
+	}
+	return nil
+}
+
+// Dispatch enqueues metrics onto every configured backend's worker.
+func Dispatch(metrics []Metric) {
+	for _, w := range workers {
+		w.enqueue(metrics)
+	}
+}
+
+// Count returns the number of currently configured backends.
+func Count() int {
+	return len(workers)
+}
@@ -0,0 +1,77 @@
+package backends
+
+import "testing"
+
+func TestNewBackend(t *testing.T) {
+	cases := []struct {
+		url     string
+		wantErr bool
+		check   func(t *testing.T, b Backend)
+	}{
+		{
+			url: "graphite://127.0.0.1:2003",
+			check: func(t *testing.T, b Backend) {
+				if _, ok := b.(*graphiteBackend); !ok {
+					t.Fatalf("got %T, want *graphiteBackend", b)
+				}
+			},
+		},
+		{
+			url: "graphite-pickle://127.0.0.1:2004",
+			check: func(t *testing.T, b Backend) {
+				if _, ok := b.(*picklebackend); !ok {
+					t.Fatalf("got %T, want *picklebackend", b)
+				}
+			},
+		},
+		{
+			url: "influx-udp://127.0.0.1:8089",
+			check: func(t *testing.T, b Backend) {
+				if _, ok := b.(*influxUDPBackend); !ok {
+					t.Fatalf("got %T, want *influxUDPBackend", b)
+				}
+			},
+		},
+		{
+			url: "redis://127.0.0.1:6379/stats",
+			check: func(t *testing.T, b Backend) {
+				r, ok := b.(*redisBackend)
+				if !ok {
+					t.Fatalf("got %T, want *redisBackend", b)
+				}
+				if r.key != "stats" {
+					t.Fatalf("got key %q, want %q", r.key, "stats")
+				}
+			},
+		},
+		{
+			url: "redis://127.0.0.1:6379",
+			check: func(t *testing.T, b Backend) {
+				r, ok := b.(*redisBackend)
+				if !ok {
+					t.Fatalf("got %T, want *redisBackend", b)
+				}
+				if r.key != "metrics" {
+					t.Fatalf("got key %q, want default %q", r.key, "metrics")
+				}
+			},
+		},
+		{url: "127.0.0.1:2003", wantErr: true},
+		{url: "bogus://host:1", wantErr: true},
+	}
+
+	for _, c := range cases {
+		b, err := New(c.url)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("New(%q): got nil error, want one", c.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("New(%q): %s", c.url, err.Error())
+			continue
+		}
+		c.check(t, b)
+	}
+}
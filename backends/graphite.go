@@ -0,0 +1,30 @@
+package backends
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// graphiteBackend is the original plaintext Graphite writer, moved out of
+// submit() into the Backend interface. Values are now float64 and printed
+// with %v rather than %d.
+type graphiteBackend struct {
+	address string
+}
+
+func (g *graphiteBackend) Name() string { return "graphite(" + g.address + ")" }
+
+func (g *graphiteBackend) Write(metrics []Metric) error {
+	conn, err := net.Dial("tcp", g.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buffer := bytes.NewBuffer([]byte{})
+	for _, m := range metrics {
+		fmt.Fprintf(buffer, "%s %v %d\n", m.Bucket, m.Value, m.Timestamp)
+	}
+	_, err = conn.Write(buffer.Bytes())
+	return err
+}
@@ -0,0 +1,60 @@
+package backends
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// influxUDPBackend writes InfluxDB line protocol over UDP; each Metric
+// becomes its own point with a single "value" field, since submit() has
+// already flattened timer stats (mean/upper/lower/...) into distinct
+// buckets. Under -tag-mode=native, m.Tags is attached as real line-protocol
+// tags instead of being folded into the measurement name.
+type influxUDPBackend struct {
+	address string
+}
+
+func (i *influxUDPBackend) Name() string { return "influx-udp(" + i.address + ")" }
+
+func (i *influxUDPBackend) Write(metrics []Metric) error {
+	conn, err := net.Dial("udp", i.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buffer := bytes.NewBuffer([]byte{})
+	for _, m := range metrics {
+		fmt.Fprintf(buffer, "%s%s value=%v %d\n", influxMeasurement(m.Bucket), influxTagSet(m.Tags), m.Value, m.Timestamp*1e9)
+	}
+	_, err = conn.Write(buffer.Bytes())
+	return err
+}
+
+func influxMeasurement(bucket string) string {
+	return strings.NewReplacer(" ", "\\ ", ",", "\\,").Replace(bucket)
+}
+
+// influxTagSet renders tags as the ",key=value,..." suffix InfluxDB line
+// protocol expects between the measurement name and the field set, with
+// keys sorted for stable output across flushes.
+func influxTagSet(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf strings.Builder
+	for _, k := range keys {
+		buf.WriteByte(',')
+		buf.WriteString(influxMeasurement(k))
+		buf.WriteByte('=')
+		buf.WriteString(influxMeasurement(tags[k]))
+	}
+	return buf.String()
+}
@@ -0,0 +1,48 @@
+package backends
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPicklePayloadShape(t *testing.T) {
+	metrics := []Metric{
+		{Bucket: "foo.bar", Value: 1.5, Timestamp: 1234},
+		{Bucket: "baz", Value: -2, Timestamp: 5678},
+	}
+	payload, err := picklePayload(metrics)
+	if err != nil {
+		t.Fatalf("picklePayload: %s", err.Error())
+	}
+
+	if payload[0] != 0x80 || payload[1] != 2 {
+		t.Fatalf("missing pickle protocol-2 header: %x", payload[:2])
+	}
+	if payload[len(payload)-1] != '.' {
+		t.Fatalf("payload does not end with STOP opcode: %x", payload[len(payload)-1])
+	}
+	for _, bucket := range []string{"foo.bar", "baz"} {
+		if !bytes.Contains(payload, []byte(bucket)) {
+			t.Errorf("payload missing bucket name %q", bucket)
+		}
+	}
+}
+
+func TestPicklePayloadLongBucketName(t *testing.T) {
+	longBucket := strings.Repeat("a", 300)
+	metrics := []Metric{{Bucket: longBucket, Value: 1, Timestamp: 1}}
+
+	payload, err := picklePayload(metrics)
+	if err != nil {
+		t.Fatalf("picklePayload: %s", err.Error())
+	}
+	if !bytes.Contains(payload, []byte(longBucket)) {
+		t.Fatalf("payload missing %d-byte bucket name", len(longBucket))
+	}
+	// A SHORT_BINSTRING ('U') length byte can't represent 300, so a bucket
+	// this long must have been written as BINSTRING ('T') instead.
+	if !bytes.Contains(payload, []byte{'T'}) {
+		t.Fatalf("expected a BINSTRING ('T') opcode for a 300-byte bucket name")
+	}
+}
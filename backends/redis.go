@@ -0,0 +1,54 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// redisBackend RPUSHes each flush's metrics, newline-joined in the same
+// "bucket value timestamp" shape as the plaintext Graphite writer, onto the
+// configured list key so downstream consumers can BLPOP/LRANGE them.
+type redisBackend struct {
+	address string
+	key     string
+}
+
+func (r *redisBackend) Name() string { return "redis(" + r.address + "/" + r.key + ")" }
+
+func (r *redisBackend) Write(metrics []Metric) error {
+	conn, err := net.Dial("tcp", r.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buffer := bytes.NewBuffer([]byte{})
+	for _, m := range metrics {
+		fmt.Fprintf(buffer, "%s %v %d\n", m.Bucket, m.Value, m.Timestamp)
+	}
+	cmd := respArray("RPUSH", r.key, buffer.String())
+	if _, err := conn.Write(cmd); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(reply, "-") {
+		return fmt.Errorf("redis: %s", strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+// respArray encodes a RESP (Redis Serialization Protocol) multi-bulk
+// command, avoiding a dependency on an external Redis client.
+func respArray(parts ...string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(parts))
+	for _, p := range parts {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(p), p)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,11 @@
+package backends
+
+import "testing"
+
+func TestRespArray(t *testing.T) {
+	got := string(respArray("RPUSH", "metrics", "foo 1 2\nbar 3 4\n"))
+	want := "*3\r\n$5\r\nRPUSH\r\n$7\r\nmetrics\r\n$16\r\nfoo 1 2\nbar 3 4\n\r\n"
+	if got != want {
+		t.Fatalf("respArray mismatch:\ngot:  %q\nwant: %q", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+
+	"statsdaemon/backends"
+)
+
+var configPath = flag.String("config", "", "path to a JSON config file; SIGHUP reloads flush-interval, percent-threshold, persist-count-keys, backends and bucket allow/deny from it")
+
+// reloadchan carries freshly-loaded Config values into monitor()'s select
+// loop so every map mutation, including the reload itself, stays on that one
+// goroutine.
+var reloadchan = make(chan *Config)
+
+// Config mirrors the subset of flags that can be safely swapped at runtime
+// without dropping in-flight aggregates.
+type Config struct {
+	FlushInterval    int64    `json:"flush_interval"`
+	PercentThreshold []string `json:"percent_threshold"`
+	PersistCountKeys int      `json:"persist_count_keys"`
+	Backends         []string `json:"backends"`
+	BucketAllow      string   `json:"bucket_allow"`
+	BucketDeny       string   `json:"bucket_deny"`
+}
+
+var (
+	bucketAllowRegexp *regexp.Regexp
+	bucketDenyRegexp  *regexp.Regexp
+)
+
+// bucketDenied reports whether bucket should be dropped under the current
+// allow/deny configuration: denied if it matches the config file's
+// bucket_deny regex, or if bucket_allow is set and it does NOT match. These
+// two are only set by a config reload; there are no flags for them.
+func bucketDenied(bucket string) bool {
+	if bucketDenyRegexp != nil && bucketDenyRegexp.MatchString(bucket) {
+		return true
+	}
+	if bucketAllowRegexp != nil && !bucketAllowRegexp.MatchString(bucket) {
+		return true
+	}
+	return false
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// watchConfigReload blocks waiting for SIGHUP and loads -config each time it
+// fires, handing the result to monitor() via reloadchan.
+func watchConfigReload(hupchan chan os.Signal) {
+	for range hupchan {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			log.Printf("config reload: %s", err.Error())
+			continue
+		}
+		reloadchan <- cfg
+	}
+}
+
+// applyConfig swaps in the reloaded settings. It must only be called from
+// monitor()'s select loop, the same place counters/gauges/timers are
+// mutated, so a reload can never race a flush.
+func applyConfig(cfg *Config) {
+	changes := []string{}
+
+	if cfg.FlushInterval > 0 && cfg.FlushInterval != *flushInterval {
+		changes = append(changes, "flush-interval")
+		*flushInterval = cfg.FlushInterval
+	}
+
+	if cfg.PercentThreshold != nil {
+		var pct Percentiles
+		for _, s := range cfg.PercentThreshold {
+			pct.Set(s)
+		}
+		percentThreshold = pct
+		changes = append(changes, "percent-threshold")
+	}
+
+	if cfg.PersistCountKeys != 0 && cfg.PersistCountKeys != -1*(*persistCountKeys) {
+		*persistCountKeys = -1 * cfg.PersistCountKeys
+		changes = append(changes, "persist-count-keys")
+	}
+
+	if cfg.Backends != nil {
+		previous := backends.Flags
+		backends.Flags = cfg.Backends
+		if err := backends.Setup("graphite://" + *graphiteAddress); err != nil {
+			log.Printf("config reload: bad backends, keeping existing ones: %s", err.Error())
+			backends.Flags = previous
+		} else {
+			changes = append(changes, "backends")
+		}
+	}
+
+	if cfg.BucketAllow != "" {
+		if re, err := regexp.Compile(cfg.BucketAllow); err == nil {
+			bucketAllowRegexp = re
+			changes = append(changes, "bucket-allow")
+		} else {
+			log.Printf("config reload: bad bucket_allow regex: %s", err.Error())
+		}
+	}
+
+	if cfg.BucketDeny != "" {
+		if re, err := regexp.Compile(cfg.BucketDeny); err == nil {
+			bucketDenyRegexp = re
+			changes = append(changes, "bucket-deny")
+		} else {
+			log.Printf("config reload: bad bucket_deny regex: %s", err.Error())
+		}
+	}
+
+	log.Printf("config reload: updated %v", changes)
+}
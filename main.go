@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log"
 	"math"
-	"net"
 	"os"
 	"os/signal"
 	"regexp"
@@ -15,6 +14,8 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"statsdaemon/backends"
 )
 
 const VERSION = "0.4.4"
@@ -22,10 +23,13 @@ const VERSION = "0.4.4"
 var signalchan chan os.Signal
 
 type Packet struct {
-	Bucket   string
-	Value    int
-	Modifier string
-	Sampling float32
+	Bucket      string
+	Value       int
+	Modifier    string
+	Sampling    float32
+	Aggregation string
+	Tags        map[string]string
+	SetMember   string
 }
 
 type Percentiles []*Percentile
@@ -64,12 +68,58 @@ func init() {
 }
 
 var (
-	In       = make(chan *Packet, 1000)
-	counters = make(map[string]int)
-	gauges   = make(map[string]int)
-	timers   = make(map[string][]int)
+	In         chan *Packet
+	counters   = make(map[string]int)
+	gauges     = make(map[string]int)
+	timers     = make(map[string]*TDigest)
+	histograms = make(map[string][]int)
+	sets       = make(map[string]map[string]struct{})
+
+	// tagsByBucket remembers the last set of DogStatsD-style tags seen for a
+	// bucket under -tag-mode=native, so flushTDigests/flushTimers/submit can
+	// attach them to the Metric they emit for a tag-aware backend to use.
+	tagsByBucket = make(map[string]map[string]string)
 )
 
+// gaugeAggregation folds one incoming gauge value into the bucket's current
+// value according to s.Aggregation. AggLast (the default, and what a plain
+// client packet carries) simply replaces the value, matching the historical
+// behavior; AggMin/AggMax/AggMean let a leaf instance ask the aggregator to
+// combine the same gauge reported by several hosts some other way.
+func gaugeAggregation(current int, hasCurrent bool, value int, agg string) int {
+	if !hasCurrent {
+		return value
+	}
+	switch agg {
+	case AggMin:
+		if value < current {
+			return value
+		}
+		return current
+	case AggMax:
+		if value > current {
+			return value
+		}
+		return current
+	case AggMean:
+		return (current + value) / 2
+	default: // AggLast, or "" for a plain (non-forwarded) packet
+		return value
+	}
+}
+
+// counterAggregation folds one incoming counter value into the bucket's
+// current total according to s.Aggregation. AggSum (the default) adds the
+// sampling-corrected value in, matching the historical behavior; AggLast
+// lets a leaf instance forward an already-summed counter that should
+// replace rather than add to the aggregator's running total.
+func counterAggregation(current int, value int, sampling float32, agg string) int {
+	if agg == AggLast {
+		return value
+	}
+	return current + int(float32(value)*(1/sampling))
+}
+
 func monitor() {
 	ticker := time.NewTicker(time.Duration(*flushInterval) * time.Second)
 	for {
@@ -78,45 +128,168 @@ func monitor() {
 			fmt.Printf("!! Caught signal %d... shutting down\n", sig)
 			submit()
 			return
+		case cfg := <-reloadchan:
+			applyConfig(cfg)
+			ticker.Stop()
+			ticker = time.NewTicker(time.Duration(*flushInterval) * time.Second)
 		case <-ticker.C:
 			submit()
+		case d := <-digestIn:
+			if _, ok := timers[d.Bucket]; !ok {
+				timers[d.Bucket] = NewTDigest()
+			}
+			timers[d.Bucket].Merge(d.Digest)
 		case s := <-In:
+			if bucketDenied(s.Bucket) {
+				continue
+			}
+			bucket := applyTagMode(s)
+			if *tagMode == "native" && len(s.Tags) > 0 {
+				tagsByBucket[bucket] = s.Tags
+			}
 			if s.Modifier == "ms" {
-				_, ok := timers[s.Bucket]
-				if !ok {
-					var t []int
-					timers[s.Bucket] = t
+				if _, ok := timers[bucket]; !ok {
+					timers[bucket] = NewTDigest()
 				}
-				timers[s.Bucket] = append(timers[s.Bucket], s.Value)
+				timers[bucket].Insert(float64(s.Value))
+			} else if s.Modifier == "h" {
+				histograms[bucket+".histogram"] = append(histograms[bucket+".histogram"], s.Value)
+			} else if s.Modifier == "s" {
+				if _, ok := sets[bucket]; !ok {
+					sets[bucket] = make(map[string]struct{})
+				}
+				sets[bucket][s.SetMember] = struct{}{}
 			} else if s.Modifier == "g" {
-				gauges[s.Bucket] = int(s.Value)
+				current, ok := gauges[bucket]
+				gauges[bucket] = gaugeAggregation(current, ok && current != -1, s.Value, s.Aggregation)
 			} else {
-				v, ok := counters[s.Bucket]
+				v, ok := counters[bucket]
 				if !ok || v < 0 {
-					counters[s.Bucket] = 0
+					v = 0
 				}
-				counters[s.Bucket] += int(float32(s.Value) * (1 / s.Sampling))
+				counters[bucket] = counterAggregation(v, s.Value, s.Sampling, s.Aggregation)
 			}
 		}
 	}
 }
 
-func submit() {
-	client, err := net.Dial("tcp", *graphiteAddress)
-	if err != nil {
-		log.Printf("Error dialing %s %s", *graphiteAddress, err.Error())
-		if *debug == false {
-			return
-		} else {
-			log.Printf("WARNING: in debug mode. resetting counters even though connection to graphite failed")
+// leafForwarder is non-nil when running in leaf mode; submit() uses it to
+// forward this instance's aggregates upstream instead of (or alongside)
+// writing directly to Graphite.
+var leafForwarder *leafForward
+
+func forwardToUpstream() {
+	var lines []string
+	for s, c := range counters {
+		lines = append(lines, encodePacket(&Packet{Bucket: s, Value: c, Modifier: "c", Aggregation: AggSum}))
+	}
+	for g, c := range gauges {
+		if c == -1 {
+			continue
+		}
+		lines = append(lines, encodePacket(&Packet{Bucket: g, Value: c, Modifier: "g", Aggregation: AggLast}))
+	}
+	for u, td := range timers {
+		// Forward the digest's centroids directly instead of re-expanding
+		// them into raw samples: the aggregator merges them into its own
+		// TDigest via TDigest.Merge, preserving the whole point of the
+		// bounded-size sketch instead of inflating it back into thousands
+		// of synthetic packets every flush.
+		lines = append(lines, encodeDigestFrame(u, td))
+	}
+	for bucket, samples := range histograms {
+		// Histograms aren't sketched like timers (flushTimers still sorts a
+		// raw []int), so there's nothing to compact: forward every sample
+		// as an "h" packet and let the aggregator accumulate its own
+		// histograms map, same as it would from a standalone instance.
+		// bucket already carries the ".histogram" suffix monitor() adds on
+		// ingestion, so strip it before re-encoding the original bucket
+		// name or the aggregator would double it up.
+		original := strings.TrimSuffix(bucket, ".histogram")
+		for _, v := range samples {
+			lines = append(lines, encodePacket(&Packet{Bucket: original, Value: v, Modifier: "h", Aggregation: AggRaw}))
+		}
+	}
+	for bucket, members := range sets {
+		for member := range members {
+			lines = append(lines, encodePacket(&Packet{Bucket: bucket, Modifier: "s", SetMember: member}))
 		}
-	} else {
-		defer client.Close()
+	}
+	if len(lines) > 0 {
+		leafForwarder.enqueue(lines)
+	}
+}
+
+// flushTDigests reduces and clears the timers map, computing the same
+// mean/upper/lower/count/percentile stats submit() always has, but off a
+// TDigest instead of a freshly-sorted []int.
+func flushTDigests(m map[string]*TDigest, now int64) []backends.Metric {
+	var metrics []backends.Metric
+	for u, td := range m {
+		if td.Count() == 0 {
+			continue
+		}
+		tags := tagsByBucket[u]
+		for _, pct := range percentThreshold {
+			metrics = append(metrics, backends.Metric{Bucket: u + ".upper_" + pct.str, Value: td.Quantile(pct.float / 100.0), Timestamp: now, Tags: tags})
+		}
+
+		metrics = append(metrics, backends.Metric{Bucket: u + ".mean", Value: td.Mean(), Timestamp: now, Tags: tags})
+		metrics = append(metrics, backends.Metric{Bucket: u + ".upper", Value: td.Max(), Timestamp: now, Tags: tags})
+		metrics = append(metrics, backends.Metric{Bucket: u + ".lower", Value: td.Min(), Timestamp: now, Tags: tags})
+		metrics = append(metrics, backends.Metric{Bucket: u + ".count", Value: float64(td.Count()), Timestamp: now, Tags: tags})
+
+		delete(m, u)
+	}
+	return metrics
+}
+
+// flushTimers reduces and clears a []int-based timer-shaped map (used for
+// histograms, which share the timer math but aren't yet sketched).
+func flushTimers(m map[string][]int, now int64) []backends.Metric {
+	var metrics []backends.Metric
+	for u, t := range m {
+		if len(t) == 0 {
+			continue
+		}
+		// histogram keys carry the ".histogram" suffix monitor() adds;
+		// tagsByBucket is keyed on the bucket without it.
+		tags := tagsByBucket[strings.TrimSuffix(u, ".histogram")]
+		sort.Ints(t)
+		min := t[0]
+		max := t[len(t)-1]
+		mean := t[len(t)/2]
+		maxAtThreshold := max
+		count := len(t)
+
+		for _, pct := range percentThreshold {
+			if len(t) > 1 {
+				indexOfPerc := int(math.Ceil(((pct.float / 100.0) * float64(count)) + 0.5))
+				if indexOfPerc >= count {
+					indexOfPerc = count - 1
+				}
+				maxAtThreshold = t[indexOfPerc]
+			}
+			metrics = append(metrics, backends.Metric{Bucket: u + ".upper_" + pct.str, Value: float64(maxAtThreshold), Timestamp: now, Tags: tags})
+		}
+
+		m[u] = nil
+
+		metrics = append(metrics, backends.Metric{Bucket: u + ".mean", Value: float64(mean), Timestamp: now, Tags: tags})
+		metrics = append(metrics, backends.Metric{Bucket: u + ".upper", Value: float64(max), Timestamp: now, Tags: tags})
+		metrics = append(metrics, backends.Metric{Bucket: u + ".lower", Value: float64(min), Timestamp: now, Tags: tags})
+		metrics = append(metrics, backends.Metric{Bucket: u + ".count", Value: float64(count), Timestamp: now, Tags: tags})
+	}
+	return metrics
+}
+
+func submit() {
+	if *mode == ModeLeaf && *upstream != "" {
+		forwardToUpstream()
 	}
 
-	numStats := 0
 	now := time.Now().Unix()
-	buffer := bytes.NewBuffer([]byte{})
+	var metrics []backends.Metric
 
 	// continue sending zeros for counters for a short period of time
 	// even if we have no new data. for more context see https://github.com/bitly/gographite/pull/8
@@ -126,78 +299,50 @@ func submit() {
 			continue
 		case c < 0:
 			counters[s] -= 1
-			fmt.Fprintf(buffer, "%s %d %d\n", s, 0, now)
+			metrics = append(metrics, backends.Metric{Bucket: s, Value: 0, Timestamp: now, Tags: tagsByBucket[s]})
 		case c >= 0:
 			counters[s] = -1
-			fmt.Fprintf(buffer, "%s %d %d\n", s, c, now)
+			metrics = append(metrics, backends.Metric{Bucket: s, Value: float64(c), Timestamp: now, Tags: tagsByBucket[s]})
 		}
-		numStats++
 	}
 
 	for g, c := range gauges {
 		if c == -1 {
 			continue
 		}
-		fmt.Fprintf(buffer, "%s %d %d\n", g, c, now)
+		metrics = append(metrics, backends.Metric{Bucket: g, Value: float64(c), Timestamp: now, Tags: tagsByBucket[g]})
 		gauges[g] = -1
-		numStats++
 	}
 
-	for u, t := range timers {
-		if len(t) > 0 {
-			numStats++
-			sort.Ints(t)
-			min := t[0]
-			max := t[len(t)-1]
-			mean := t[len(t)/2]
-			maxAtThreshold := max
-			count := len(t)
-
-			for _, pct := range percentThreshold {
-
-				if len(t) > 1 {
-					indexOfPerc := int(math.Ceil(((pct.float / 100.0) * float64(count)) + 0.5))
-					if indexOfPerc >= count {
-						indexOfPerc = count - 1
-					}
-					maxAtThreshold = t[indexOfPerc]
-				}
-
-				fmt.Fprintf(buffer, "%s.upper_%s %d %d\n", u, pct.str, maxAtThreshold, now)
-			}
+	metrics = append(metrics, flushTDigests(timers, now)...)
+	metrics = append(metrics, flushTimers(histograms, now)...)
 
-			var z []int
-			timers[u] = z
-
-			fmt.Fprintf(buffer, "%s.mean %d %d\n", u, mean, now)
-			fmt.Fprintf(buffer, "%s.upper %d %d\n", u, max, now)
-			fmt.Fprintf(buffer, "%s.lower %d %d\n", u, min, now)
-			fmt.Fprintf(buffer, "%s.count %d %d\n", u, count, now)
-		}
+	for u, vals := range sets {
+		metrics = append(metrics, backends.Metric{Bucket: u + ".count", Value: float64(len(vals)), Timestamp: now, Tags: tagsByBucket[u]})
+		delete(sets, u)
 	}
-	if numStats == 0 {
+
+	if len(metrics) == 0 {
 		return
 	}
-	data := buffer.Bytes()
-	if client != nil {
-		log.Printf("sent %d stats to %s", numStats, *graphiteAddress)
-		client.Write(data)
-	}
+
+	log.Printf("sent %d stats to %d backend(s)", len(metrics), backends.Count())
+	backends.Dispatch(metrics)
+
 	if *debug {
-		lines := bytes.NewBuffer(data)
-		for {
-			line, err := lines.ReadString([]byte("\n")[0])
-			if line == "" || err != nil {
-				break
-			}
-			log.Printf("debug: %s", line)
+		for _, m := range metrics {
+			log.Printf("debug: %s %v %d", m.Bucket, m.Value, m.Timestamp)
 		}
 	}
 }
 
-func parseMessage(buf *bytes.Buffer) []*Packet {
-	var packetRegexp = regexp.MustCompile("^([^:]+):([0-9]+)\\|(g|c|ms)(\\|@([0-9\\.]+))?\n?$")
+// packetRegexp's value group is intentionally permissive (not just digits):
+// set ("s") members are arbitrary strings in practice (user IDs, session
+// tokens), not necessarily numeric, so parseMessage decides how to interpret
+// item[2] per-modifier instead of the regex enforcing a numeric shape.
+var packetRegexp = regexp.MustCompile("^([^:]+):([^|]+)\\|(g|c|ms|s|h)(\\|@([0-9\\.]+))?(\\|#([^\n]+))?\n?$")
 
+func parseMessage(buf *bytes.Buffer) []*Packet {
 	var output []*Packet
 	var err error
 	var line string
@@ -211,15 +356,7 @@ func parseMessage(buf *bytes.Buffer) []*Packet {
 			if len(item) == 0 {
 				continue
 			}
-			value, err := strconv.Atoi(item[2])
-			if err != nil {
-				// todo print out this error
-				if item[3] == "ms" {
-					value = 0
-				} else {
-					value = 1
-				}
-			}
+			modifier := item[3]
 
 			sampleRate, err := strconv.ParseFloat(item[5], 32)
 			if err != nil {
@@ -228,39 +365,32 @@ func parseMessage(buf *bytes.Buffer) []*Packet {
 
 			packet := &Packet{
 				Bucket:   item[1],
-				Value:    value,
-				Modifier: item[3],
+				Modifier: modifier,
 				Sampling: float32(sampleRate),
+				Tags:     parseTags(item[7]),
+			}
+
+			if modifier == "s" {
+				packet.SetMember = item[2]
+			} else {
+				value, err := strconv.Atoi(item[2])
+				if err != nil {
+					// todo print out this error
+					if modifier == "ms" {
+						value = 0
+					} else {
+						value = 1
+					}
+				}
+				packet.Value = value
 			}
+
 			output = append(output, packet)
 		}
 	}
 	return output
 }
 
-func udpListener() {
-	address, _ := net.ResolveUDPAddr("udp", *serviceAddress)
-	log.Printf("Listening on %s", address)
-	listener, err := net.ListenUDP("udp", address)
-	if err != nil {
-		log.Fatalf("ListenAndServe: %s", err.Error())
-	}
-	defer listener.Close()
-	message := make([]byte, 512)
-	for {
-		n, remaddr, err := listener.ReadFrom(message)
-		if err != nil {
-			log.Printf("error reading from %v %s", remaddr, err.Error())
-			continue
-		}
-		buf := bytes.NewBuffer(message[0:n])
-		packets := parseMessage(buf)
-		for _, p := range packets {
-			In <- p
-		}
-	}
-}
-
 func main() {
 	flag.Parse()
 	if *showVersion {
@@ -270,7 +400,23 @@ func main() {
 	signalchan = make(chan os.Signal, 1)
 	signal.Notify(signalchan, syscall.SIGTERM)
 	*persistCountKeys = -1 * (*persistCountKeys)
+	In = make(chan *Packet, *inChanSize)
+	if err := backends.Setup("graphite://" + *graphiteAddress); err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+
+	if *configPath != "" {
+		hupchan := make(chan os.Signal, 1)
+		signal.Notify(hupchan, syscall.SIGHUP)
+		go watchConfigReload(hupchan)
+	}
 
+	if *mode == ModeAggregator {
+		go tcpListener()
+	}
+	if *mode == ModeLeaf {
+		leafForwarder = newLeafForward()
+	}
 	go udpListener()
 	monitor()
 }
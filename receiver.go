@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"net"
+	"sync"
+)
+
+// maxPacketSize is the largest UDP datagram we expect from a statsd client;
+// it matches the buffer size the original single-goroutine udpListener used.
+const maxPacketSize = 512
+
+var (
+	udpReaders    = flag.Int("udp-readers", 1, "number of goroutines reading from the UDP socket")
+	parserWorkers = flag.Int("parser-workers", 1, "number of goroutines parsing raw datagrams into packets")
+	inChanSize    = flag.Int("in-channel-size", 1000, "size of the In channel shared between parsers and monitor()")
+)
+
+// rawPacket is a datagram pulled off the wire. buf is a buffer borrowed from
+// rawPacketPool, valid through buf[:n]; parseWorker returns it to the pool
+// once parseMessage is done reading it, so no per-packet allocation happens
+// between a read and its parse.
+type rawPacket struct {
+	buf *[]byte
+	n   int
+}
+
+var rawPacketPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, maxPacketSize)
+		return &b
+	},
+}
+
+// udpListener starts the configured number of reader and parser goroutines
+// and blocks until the process exits. Readers share a single *net.UDPConn
+// (each call to ReadFrom is independent, so this fans datagrams out across
+// goroutines without SO_REUSEPORT); parsers drain the raw channel and push
+// finished Packets onto the existing In channel, which remains the sole
+// synchronization point with monitor().
+func udpListener() {
+	address, _ := net.ResolveUDPAddr("udp", *serviceAddress)
+	log.Printf("Listening on %s (%d readers, %d parser workers)", address, *udpReaders, *parserWorkers)
+	listener, err := net.ListenUDP("udp", address)
+	if err != nil {
+		log.Fatalf("ListenAndServe: %s", err.Error())
+	}
+
+	raw := make(chan rawPacket, *inChanSize)
+
+	for i := 0; i < *udpReaders; i++ {
+		go readUDP(listener, raw)
+	}
+	for i := 0; i < *parserWorkers; i++ {
+		go parseWorker(raw)
+	}
+
+	select {}
+}
+
+func readUDP(listener *net.UDPConn, raw chan<- rawPacket) {
+	for {
+		buf := rawPacketPool.Get().(*[]byte)
+		n, remaddr, err := listener.ReadFrom(*buf)
+		if err != nil {
+			log.Printf("error reading from %v %s", remaddr, err.Error())
+			rawPacketPool.Put(buf)
+			continue
+		}
+		raw <- rawPacket{buf: buf, n: n}
+	}
+}
+
+func parseWorker(raw <-chan rawPacket) {
+	for r := range raw {
+		buf := bytes.NewBuffer((*r.buf)[:r.n])
+		packets := parseMessage(buf)
+		for _, p := range packets {
+			In <- p
+		}
+		rawPacketPool.Put(r.buf)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkUDPReceive measures packets/sec the reader+parser pool can sustain
+// and how many of the b.N packets written actually arrive as Packets on In,
+// which is what "loss thresholds" actually means here: a received count
+// short of b.N is loss, not just a slower wall clock. Run with -bench=.
+// -udp-readers/-parser-workers left at their flag defaults unless overridden
+// on the command line.
+func BenchmarkUDPReceive(b *testing.B) {
+	*serviceAddress = "127.0.0.1:0"
+	address, _ := net.ResolveUDPAddr("udp", *serviceAddress)
+	listener, err := net.ListenUDP("udp", address)
+	if err != nil {
+		b.Fatalf("ListenUDP: %s", err)
+	}
+	defer listener.Close()
+
+	raw := make(chan rawPacket, *inChanSize)
+	In = make(chan *Packet, *inChanSize)
+	for i := 0; i < *udpReaders; i++ {
+		go readUDP(listener, raw)
+	}
+	for i := 0; i < *parserWorkers; i++ {
+		go parseWorker(raw)
+	}
+	var received int64
+	go func() {
+		for range In {
+			atomic.AddInt64(&received, 1)
+		}
+	}()
+
+	client, err := net.Dial("udp", listener.LocalAddr().String())
+	if err != nil {
+		b.Fatalf("Dial: %s", err)
+	}
+	defer client.Close()
+
+	msg := []byte("bench.counter:1|c\n")
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		client.Write(msg)
+	}
+
+	// Packets can still be in flight after the last Write returns; poll
+	// until the received count catches up or stops climbing, rather than a
+	// fixed sleep, so a slow run isn't mistaken for loss.
+	deadline := time.Now().Add(2 * time.Second)
+	last := int64(-1)
+	for time.Now().Before(deadline) {
+		got := atomic.LoadInt64(&received)
+		if got == int64(b.N) || got == last {
+			break
+		}
+		last = got
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.StopTimer()
+	elapsed := time.Since(start)
+
+	got := atomic.LoadInt64(&received)
+	lossPct := 100 * float64(int64(b.N)-got) / float64(b.N)
+	b.ReportMetric(float64(got)/elapsed.Seconds(), "packets/sec")
+	b.ReportMetric(lossPct, "loss-pct")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"strings"
+)
+
+var (
+	tagMode      = flag.String("tag-mode", "append", "one of append|drop|native: how DogStatsD-style |#tags are represented for tag-unaware backends")
+	tagSeparator = flag.String("tag-separator", ".", "separator used to fold tags into the bucket name in append mode")
+)
+
+// parseTags turns a DogStatsD-style "tag1:val1,tag2:val2" block into a map.
+// A bare tag with no ":value" is kept with an empty value, matching how
+// DogStatsD treats flag-style tags.
+func parseTags(s string) map[string]string {
+	if s == "" {
+		return nil
+	}
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(pair, ":")
+		tags[k] = v
+	}
+	return tags
+}
+
+// applyTagMode returns the bucket name monitor() should key its aggregation
+// maps on, given the current -tag-mode:
+//   - "drop": tags are discarded, plain Graphite bucket naming (default pre-tags behavior)
+//   - "append": tags are folded into the bucket name with -tag-separator, so
+//     plain Graphite still gets a sensible, tag-distinguishing bucket
+//   - "native": the bucket name is left untouched; p.Tags is carried through
+//     on the Metric (via tagsByBucket) so a tag-aware backend, like
+//     influx-udp, can attach them natively instead of folding them into the
+//     bucket name
+func applyTagMode(p *Packet) string {
+	if len(p.Tags) == 0 {
+		return p.Bucket
+	}
+	switch *tagMode {
+	case "native", "drop":
+		return p.Bucket
+	default: // "append"
+		keys := make([]string, 0, len(p.Tags))
+		for k := range p.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, 0, len(keys))
+		for _, k := range keys {
+			if v := p.Tags[k]; v == "" {
+				parts = append(parts, k)
+			} else {
+				parts = append(parts, k+"_"+v)
+			}
+		}
+		return p.Bucket + *tagSeparator + strings.Join(parts, *tagSeparator)
+	}
+}
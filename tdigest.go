@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// tdigestCompactThreshold bounds how many centroids a TDigest accumulates
+// before it reshuffles and reinserts them, keeping memory per bucket roughly
+// constant regardless of how many samples flow through.
+const tdigestCompactThreshold = 1000
+
+// Centroid is one (mean, weight) pair in a TDigest.
+type Centroid struct {
+	Mean   float64
+	Weight float64
+}
+
+// TDigest is a compact, mergeable sketch of a distribution. It replaces the
+// old "sort every sample at flush time" timer path: inserts and merges are
+// O(centroids) instead of O(n log n) over every sample seen in the flush
+// interval, and two digests (e.g. from different leaf statsdaemons in
+// aggregator mode) can be combined without needing the original samples.
+type TDigest struct {
+	Delta     float64
+	centroids []Centroid
+	count     float64
+}
+
+// NewTDigest returns a digest using delta=100. The number of centroids is
+// not fixed: under sizeBound it grows slowly (roughly logarithmically) with
+// the sample count, and compact() runs once it exceeds
+// tdigestCompactThreshold.
+func NewTDigest() *TDigest {
+	return &TDigest{Delta: 100}
+}
+
+// Insert adds a single sample to the digest.
+func (t *TDigest) Insert(x float64) {
+	t.insertWeighted(x, 1)
+}
+
+// InsertWeighted adds a centroid's (mean, weight) pair to the digest without
+// reconstructing its original samples, e.g. when merging in centroids
+// decoded off the wire from another instance's digest.
+func (t *TDigest) InsertWeighted(x, w float64) {
+	t.insertWeighted(x, w)
+}
+
+func (t *TDigest) insertWeighted(x, w float64) {
+	t.count += w
+	if len(t.centroids) == 0 {
+		t.centroids = append(t.centroids, Centroid{x, w})
+		return
+	}
+
+	idx := t.nearest(x)
+	if idx >= 0 && t.centroids[idx].Weight+w <= t.sizeBound(idx) {
+		c := &t.centroids[idx]
+		c.Mean += (x - c.Mean) * w / (c.Weight + w)
+		c.Weight += w
+	} else {
+		insertAt := t.searchInsertionPoint(x)
+		t.centroids = append(t.centroids, Centroid{})
+		copy(t.centroids[insertAt+1:], t.centroids[insertAt:])
+		t.centroids[insertAt] = Centroid{x, w}
+	}
+
+	if len(t.centroids) > tdigestCompactThreshold {
+		t.compact()
+	}
+}
+
+// searchInsertionPoint finds where x belongs to keep centroids sorted by mean.
+func (t *TDigest) searchInsertionPoint(x float64) int {
+	lo, hi := 0, len(t.centroids)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if t.centroids[mid].Mean < x {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// nearest returns the index of the centroid whose mean is closest to x.
+func (t *TDigest) nearest(x float64) int {
+	idx := t.searchInsertionPoint(x)
+	best, bestDist := -1, math.MaxFloat64
+	if idx < len(t.centroids) {
+		best, bestDist = idx, math.Abs(t.centroids[idx].Mean-x)
+	}
+	if idx > 0 {
+		if d := math.Abs(t.centroids[idx-1].Mean - x); d < bestDist {
+			best = idx - 1
+		}
+	}
+	return best
+}
+
+// sizeBound returns the maximum weight centroid idx may carry before a new
+// sample near it must become its own centroid instead of merging in:
+// 4*n*q*(1-q)/delta, where q is the centroid's cumulative quantile. The
+// allowed weight shrinks the further q is from the median. This is not the
+// asin scale function k(q) = (delta/2pi)*(asin(2q-1)+pi/2).
+func (t *TDigest) sizeBound(idx int) float64 {
+	if t.count == 0 {
+		return math.MaxFloat64
+	}
+	var cum float64
+	for i := 0; i < idx; i++ {
+		cum += t.centroids[i].Weight
+	}
+	q := (cum + t.centroids[idx].Weight/2) / t.count
+	return 4 * t.count * q * (1 - q) / t.Delta
+}
+
+// compact reinserts every centroid in shuffled order, which in practice
+// keeps the digest from accumulating more centroids than the size bound
+// intends as it grows.
+func (t *TDigest) compact() {
+	old := t.centroids
+	t.centroids = nil
+	t.count = 0
+	for _, i := range rand.Perm(len(old)) {
+		t.insertWeighted(old[i].Mean, old[i].Weight)
+	}
+}
+
+// Merge folds another digest's centroids into this one, e.g. combining
+// per-host digests forwarded to an aggregator instance.
+func (t *TDigest) Merge(other *TDigest) {
+	for _, c := range other.centroids {
+		t.insertWeighted(c.Mean, c.Weight)
+	}
+}
+
+// Quantile walks the centroids accumulating weight and linearly interpolates
+// between neighboring centroid means at the target cumulative weight.
+func (t *TDigest) Quantile(q float64) float64 {
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	if len(t.centroids) == 1 {
+		return t.centroids[0].Mean
+	}
+	target := q * t.count
+	var cum float64
+	for i, c := range t.centroids {
+		if i == len(t.centroids)-1 || cum+c.Weight >= target {
+			if i == 0 {
+				return c.Mean
+			}
+			prev := t.centroids[i-1]
+			fraction := (target - cum) / c.Weight
+			return prev.Mean + fraction*(c.Mean-prev.Mean)
+		}
+		cum += c.Weight
+	}
+	return t.centroids[len(t.centroids)-1].Mean
+}
+
+// Min, Max, Mean and Count give the same summary stats submit() used to
+// compute directly off the sorted []int.
+func (t *TDigest) Min() float64 {
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	return t.centroids[0].Mean
+}
+
+func (t *TDigest) Max() float64 {
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	return t.centroids[len(t.centroids)-1].Mean
+}
+
+func (t *TDigest) Mean() float64 {
+	if t.count == 0 {
+		return 0
+	}
+	var sum float64
+	for _, c := range t.centroids {
+		sum += c.Mean * c.Weight
+	}
+	return sum / t.count
+}
+
+func (t *TDigest) Count() int {
+	return int(t.count)
+}
+
+// Centroids returns a read-only snapshot, used to forward this digest
+// upstream in leaf mode without exposing the internal slice.
+func (t *TDigest) Centroids() []Centroid {
+	out := make([]Centroid, len(t.centroids))
+	copy(out, t.centroids)
+	return out
+}